@@ -0,0 +1,122 @@
+package interceptor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// PostgresInterceptStore is the Postgres-backed InterceptStore. Revocation
+// state lives in two tables: opening_fee_params_promise_revocations (one row
+// per individually revoked menu entry) and opening_fee_params_revoked_before,
+// a single-row table holding the RevokeAllIssuedBefore cutoff.
+type PostgresInterceptStore struct {
+	pool *pgxpool.Pool
+}
+
+func NewPostgresInterceptStore(pool *pgxpool.Pool) *PostgresInterceptStore {
+	return &PostgresInterceptStore{pool: pool}
+}
+
+var _ InterceptStore = (*PostgresInterceptStore)(nil)
+
+func (s *PostgresInterceptStore) GetFeeParamsSettings(token string) ([]*OpeningFeeParamsSetting, error) {
+	rows, err := s.pool.Query(
+		context.Background(),
+		`SELECT validity_seconds, min_msat, proportional, max_idle_time, max_client_to_self_delay
+		 FROM opening_fee_params_settings
+		 WHERE token=$1
+		 ORDER BY min_msat, proportional`,
+		token,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query opening_fee_params_settings: %w", err)
+	}
+	defer rows.Close()
+
+	var settings []*OpeningFeeParamsSetting
+	for rows.Next() {
+		var validitySeconds uint64
+		var setting OpeningFeeParamsSetting
+		err := rows.Scan(
+			&validitySeconds,
+			&setting.Params.MinMsat,
+			&setting.Params.Proportional,
+			&setting.Params.MaxIdleTime,
+			&setting.Params.MaxClientToSelfDelay,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan opening_fee_params_settings row: %w", err)
+		}
+
+		setting.Validity = time.Duration(validitySeconds) * time.Second
+		settings = append(settings, &setting)
+	}
+
+	return settings, rows.Err()
+}
+
+func (s *PostgresInterceptStore) IsOpeningFeeParamsPromiseRevoked(hash []byte) (bool, error) {
+	var exists bool
+	err := s.pool.QueryRow(
+		context.Background(),
+		`SELECT EXISTS(SELECT 1 FROM opening_fee_params_promise_revocations WHERE hash=$1)`,
+		hash,
+	).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to query opening_fee_params_promise_revocations: %w", err)
+	}
+
+	return exists, nil
+}
+
+func (s *PostgresInterceptStore) RevokeOpeningFeeParamsPromise(hash []byte) error {
+	_, err := s.pool.Exec(
+		context.Background(),
+		`INSERT INTO opening_fee_params_promise_revocations (hash, revoked_at)
+		 VALUES ($1, now())
+		 ON CONFLICT (hash) DO NOTHING`,
+		hash,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert into opening_fee_params_promise_revocations: %w", err)
+	}
+
+	return nil
+}
+
+func (s *PostgresInterceptStore) GetOpeningFeeParamsRevokedBefore() (time.Time, error) {
+	var revokedBefore time.Time
+	err := s.pool.QueryRow(
+		context.Background(),
+		`SELECT revoked_before FROM opening_fee_params_revoked_before WHERE id=true`,
+	).Scan(&revokedBefore)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to query opening_fee_params_revoked_before: %w", err)
+	}
+
+	return revokedBefore.UTC(), nil
+}
+
+func (s *PostgresInterceptStore) SetOpeningFeeParamsRevokedBefore(t time.Time) error {
+	_, err := s.pool.Exec(
+		context.Background(),
+		`INSERT INTO opening_fee_params_revoked_before (id, revoked_before)
+		 VALUES (true, $1)
+		 ON CONFLICT (id) DO UPDATE SET revoked_before = $1
+		 WHERE opening_fee_params_revoked_before.revoked_before < $1`,
+		t.UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to upsert opening_fee_params_revoked_before: %w", err)
+	}
+
+	return nil
+}
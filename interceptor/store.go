@@ -0,0 +1,37 @@
+package interceptor
+
+import (
+	"time"
+
+	"github.com/breez/lspd/basetypes"
+)
+
+// InterceptStore is the persistence surface used by the interceptor and the
+// shared.OpeningService it backs.
+type InterceptStore interface {
+	GetFeeParamsSettings(token string) ([]*OpeningFeeParamsSetting, error)
+
+	// IsOpeningFeeParamsPromiseRevoked reports whether hash (as produced by
+	// revocationKeyHash in package shared) was revoked via
+	// RevokeOpeningFeeParamsPromise.
+	IsOpeningFeeParamsPromiseRevoked(hash []byte) (bool, error)
+	// RevokeOpeningFeeParamsPromise revokes every promise that hashes to
+	// hash, persisting the revocation so it survives restarts.
+	RevokeOpeningFeeParamsPromise(hash []byte) error
+	// GetOpeningFeeParamsRevokedBefore returns the latest cutoff ever passed
+	// to SetOpeningFeeParamsRevokedBefore, or the zero time if none has
+	// ever been set.
+	GetOpeningFeeParamsRevokedBefore() (time.Time, error)
+	// SetOpeningFeeParamsRevokedBefore persists t as the new cutoff if it
+	// is later than the current one; an earlier t leaves the cutoff as it
+	// is. Every opening fee params promise issued at or before the cutoff
+	// is rejected, without the store needing to know any of their hashes.
+	SetOpeningFeeParamsRevokedBefore(t time.Time) error
+}
+
+// OpeningFeeParamsSetting is a single configured menu entry: the fee terms
+// an LSP offers, plus how long a promise for them stays valid.
+type OpeningFeeParamsSetting struct {
+	Validity time.Duration
+	Params   basetypes.OpeningFeeParams
+}
@@ -2,45 +2,39 @@ package itest
 
 import (
 	"context"
-	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"sort"
-	"strconv"
 	"sync"
 	"time"
 
-	"github.com/breez/lntest"
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
 	"github.com/jackc/pgx/v4/pgxpool"
+	_ "github.com/jackc/pgx/v4/stdlib"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
 )
 
+const postgresSnapshotName = "lspd_itest_base"
+
 type PostgresContainer struct {
-	id            string
+	container     testcontainers.Container
 	password      string
-	port          uint32
-	cli           *client.Client
+	port          nat.Port
 	logfile       string
 	isInitialized bool
 	isStarted     bool
+	hasSnapshot   bool
 	mtx           sync.Mutex
 }
 
 func NewPostgresContainer(logfile string) (*PostgresContainer, error) {
-	port, err := lntest.GetPort()
-	if err != nil {
-		return nil, fmt.Errorf("could not get port: %w", err)
-	}
-
 	return &PostgresContainer{
 		password: "pgpassword",
-		port:     port,
+		logfile:  logfile,
 	}, nil
 }
 
@@ -48,120 +42,77 @@ func (c *PostgresContainer) Start(ctx context.Context) error {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
 
-	var err error
 	if c.isStarted {
 		return nil
 	}
 
-	c.cli, err = client.NewClientWithOpts(client.FromEnv)
-	if err != nil {
-		return fmt.Errorf("could not create docker client: %w", err)
-	}
-
 	if !c.isInitialized {
-		err := c.initialize(ctx)
-		if err != nil {
-			c.cli.Close()
+		if err := c.initialize(ctx); err != nil {
 			return err
 		}
 	}
 
-	err = c.cli.ContainerStart(ctx, c.id, types.ContainerStartOptions{})
-	if err != nil {
-		c.cli.Close()
-		return fmt.Errorf("failed to start docker container '%s': %w", c.id, err)
+	if err := c.container.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start postgres container: %w", err)
 	}
 	c.isStarted = true
 
-HealthCheck:
-	for {
-		inspect, err := c.cli.ContainerInspect(ctx, c.id)
-		if err != nil {
-			c.cli.ContainerStop(ctx, c.id, nil)
-			c.cli.Close()
-			return fmt.Errorf("failed to inspect container '%s' during healthcheck: %w", c.id, err)
-		}
+	// On reuse this is the port the container was originally published on,
+	// not whatever this process happened to pick -- ConnectionString must
+	// use it rather than a process-local guess.
+	mappedPort, err := c.container.MappedPort(ctx, "5432/tcp")
+	if err != nil {
+		return fmt.Errorf("failed to get mapped postgres port: %w", err)
+	}
+	c.port = mappedPort
 
-		status := inspect.State.Health.Status
-		switch status {
-		case "unhealthy":
-			c.cli.ContainerStop(ctx, c.id, nil)
-			c.cli.Close()
-			return fmt.Errorf("container '%s' unhealthy", c.id)
-		case "healthy":
-			for {
-				pgxPool, err := pgxpool.Connect(ctx, c.ConnectionString())
-				if err == nil {
-					pgxPool.Close()
-					break HealthCheck
-				}
-
-				<-time.After(50 * time.Millisecond)
-			}
-		default:
-			<-time.After(200 * time.Millisecond)
-		}
+	logs, err := c.container.Logs(ctx)
+	if err == nil {
+		go streamContainerLogs(logs, c.logfile)
 	}
 
-	go c.monitorLogs(ctx)
 	return nil
 }
 
 func (c *PostgresContainer) initialize(ctx context.Context) error {
-	image := "postgres:15"
-	_, _, err := c.cli.ImageInspectWithRaw(ctx, image)
-	if err != nil {
-		if !client.IsErrNotFound(err) {
-			return fmt.Errorf("could not find docker image '%s': %w", image, err)
-		}
-
-		pullReader, err := c.cli.ImagePull(ctx, image, types.ImagePullOptions{})
-		if err != nil {
-			return fmt.Errorf("failed to pull docker image '%s': %w", image, err)
-		}
-		defer pullReader.Close()
-
-		_, err = io.Copy(io.Discard, pullReader)
-		if err != nil {
-			return fmt.Errorf("failed to download docker image '%s': %w", image, err)
-		}
-	}
-
-	createResp, err := c.cli.ContainerCreate(ctx, &container.Config{
-		Image: image,
+	req := testcontainers.ContainerRequest{
+		// Reuse matches containers by name, not by label, so this must be
+		// deterministic across test binaries for reuse to actually happen.
+		// The host port is left for Docker to assign (and, on reuse, already
+		// assigned by whichever process started the container first) --
+		// ConnectionString reads the real mapped port back out after Start
+		// instead of pinning one here.
+		Name:         "lspd-itest-postgres",
+		Image:        "postgres:15",
+		ExposedPorts: []string{"5432/tcp"},
 		Cmd: []string{
 			"postgres",
 			"-c",
 			"log_statement=all",
 		},
-		Env: []string{
-			"POSTGRES_DB=postgres",
-			"POSTGRES_PASSWORD=pgpassword",
-			"POSTGRES_USER=postgres",
-		},
-		Healthcheck: &container.HealthConfig{
-			Test:     []string{"CMD-SHELL", "pg_isready -U postgres"},
-			Interval: time.Second,
-			Timeout:  time.Second,
-			Retries:  10,
+		Env: map[string]string{
+			"POSTGRES_DB":       "postgres",
+			"POSTGRES_PASSWORD": c.password,
+			"POSTGRES_USER":     "postgres",
 		},
-	}, &container.HostConfig{
-		PortBindings: nat.PortMap{
-			"5432/tcp": []nat.PortBinding{
-				{HostPort: strconv.FormatUint(uint64(c.port), 10)},
-			},
+		WaitingFor: wait.ForSQL(nat.Port("5432/tcp"), "pgx", func(host string, port nat.Port) string {
+			return fmt.Sprintf("postgres://postgres:%s@%s:%s/postgres", c.password, host, port.Port())
+		}).WithStartupTimeout(30 * time.Second),
+		Labels: map[string]string{
+			"lspd-itest-reuse": "postgres",
 		},
-	},
-		nil,
-		nil,
-		"",
-	)
+	}
 
+	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          false,
+		Reuse:            true,
+	})
 	if err != nil {
-		return fmt.Errorf("failed to create docker container: %w", err)
+		return fmt.Errorf("failed to create postgres container: %w", err)
 	}
 
-	c.id = createResp.ID
+	c.container = container
 	c.isInitialized = true
 	return nil
 }
@@ -174,8 +125,7 @@ func (c *PostgresContainer) Stop(ctx context.Context) error {
 		return nil
 	}
 
-	defer c.cli.Close()
-	err := c.cli.ContainerStop(ctx, c.id, nil)
+	err := c.container.Stop(ctx, nil)
 	c.isStarted = false
 	return err
 }
@@ -183,58 +133,31 @@ func (c *PostgresContainer) Stop(ctx context.Context) error {
 func (c *PostgresContainer) Cleanup(ctx context.Context) error {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
-	cli, err := client.NewClientWithOpts(client.FromEnv)
-	if err != nil {
-		return err
+
+	if c.container == nil {
+		return nil
 	}
-	defer cli.Close()
-	return cli.ContainerRemove(ctx, c.id, types.ContainerRemoveOptions{
-		Force: true,
-	})
+
+	// Ryuk (testcontainers' reaper) removes orphaned containers on its own,
+	// but we still terminate explicitly when a test run asks us to clean up.
+	return c.container.Terminate(ctx)
 }
 
-func (c *PostgresContainer) monitorLogs(ctx context.Context) {
-	i, err := c.cli.ContainerLogs(ctx, c.id, types.ContainerLogsOptions{
-		ShowStderr: true,
-		ShowStdout: true,
-		Timestamps: false,
-		Follow:     true,
-		Tail:       "40",
-	})
-	if err != nil {
-		log.Printf("Could not get container logs: %v", err)
-		return
-	}
-	defer i.Close()
+func streamContainerLogs(logs io.ReadCloser, logfile string) {
+	defer logs.Close()
 
-	file, err := os.OpenFile(c.logfile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	file, err := os.OpenFile(logfile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
 	if err != nil {
 		log.Printf("Could not create container log file: %v", err)
 		return
 	}
 	defer file.Close()
 
-	hdr := make([]byte, 8)
-	for {
-		_, err := i.Read(hdr)
-		if err != nil {
-			return
-		}
-		count := binary.BigEndian.Uint32(hdr[4:])
-		dat := make([]byte, count)
-		_, err = i.Read(dat)
-		if err != nil {
-			return
-		}
-		_, err = file.Write(dat)
-		if err != nil {
-			return
-		}
-	}
+	io.Copy(file, logs)
 }
 
 func (c *PostgresContainer) ConnectionString() string {
-	return fmt.Sprintf("postgres://postgres:%s@127.0.0.1:%d/postgres", c.password, c.port)
+	return fmt.Sprintf("postgres://postgres:%s@127.0.0.1:%s/postgres", c.password, c.port.Port())
 }
 
 func (c *PostgresContainer) RunMigrations(ctx context.Context, migrationDir string) error {
@@ -263,5 +186,53 @@ func (c *PostgresContainer) RunMigrations(ctx context.Context, migrationDir stri
 		}
 	}
 
+	return c.Snapshot(ctx)
+}
+
+// Snapshot takes a pg_dump of the current database state and stores it
+// inside the container, so a later Reset can restore to this point without
+// paying the cost of starting a fresh container.
+func (c *PostgresContainer) Snapshot(ctx context.Context) error {
+	exitCode, reader, err := c.container.Exec(ctx, []string{
+		"sh", "-c",
+		fmt.Sprintf("pg_dump -U postgres postgres > /tmp/%s.sql", postgresSnapshotName),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to snapshot postgres database: %w", err)
+	}
+	if exitCode != 0 {
+		out, _ := io.ReadAll(reader)
+		return fmt.Errorf("pg_dump exited with code %d: %s", exitCode, out)
+	}
+
+	c.hasSnapshot = true
+	return nil
+}
+
+// Reset restores the database to the snapshot taken after RunMigrations,
+// discarding any state a test case has accumulated since.
+func (c *PostgresContainer) Reset(ctx context.Context) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if !c.hasSnapshot {
+		return fmt.Errorf("no snapshot to restore, call Snapshot (or RunMigrations) first")
+	}
+
+	script := fmt.Sprintf(
+		"psql -U postgres -c 'DROP SCHEMA public CASCADE; CREATE SCHEMA public;' postgres && "+
+			"psql -U postgres -f /tmp/%s.sql postgres",
+		postgresSnapshotName,
+	)
+
+	exitCode, reader, err := c.container.Exec(ctx, []string{"sh", "-c", script})
+	if err != nil {
+		return fmt.Errorf("failed to restore postgres snapshot: %w", err)
+	}
+	if exitCode != 0 {
+		out, _ := io.ReadAll(reader)
+		return fmt.Errorf("snapshot restore exited with code %d: %s", exitCode, out)
+	}
+
 	return nil
 }
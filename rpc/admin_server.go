@@ -0,0 +1,52 @@
+package rpc
+
+import (
+	"context"
+	"time"
+
+	"github.com/breez/lspd/shared"
+)
+
+// RevokePromiseRequest/Reply and RevokeAllIssuedBeforeRequest/Reply mirror
+// the messages in admin.proto, with IssuedBefore as a time.Time rather than
+// a protobuf Timestamp. They are defined by hand here rather than generated
+// from admin.proto; code generated from it would replace these four types,
+// not AdminServer.
+type RevokePromiseRequest struct {
+	Hash []byte
+}
+
+type RevokePromiseReply struct{}
+
+type RevokeAllIssuedBeforeRequest struct {
+	IssuedBefore time.Time
+}
+
+type RevokeAllIssuedBeforeReply struct{}
+
+// AdminServer implements the AdminService RPCs defined in admin.proto,
+// delegating to the shared.OpeningService that actually owns the
+// revocation state.
+type AdminServer struct {
+	openingService shared.OpeningService
+}
+
+func NewAdminServer(openingService shared.OpeningService) *AdminServer {
+	return &AdminServer{openingService: openingService}
+}
+
+func (s *AdminServer) RevokePromise(ctx context.Context, req *RevokePromiseRequest) (*RevokePromiseReply, error) {
+	if err := s.openingService.RevokePromise(req.Hash); err != nil {
+		return nil, err
+	}
+
+	return &RevokePromiseReply{}, nil
+}
+
+func (s *AdminServer) RevokeAllIssuedBefore(ctx context.Context, req *RevokeAllIssuedBeforeRequest) (*RevokeAllIssuedBeforeReply, error) {
+	if err := s.openingService.RevokeAllIssuedBefore(req.IssuedBefore); err != nil {
+		return nil, err
+	}
+
+	return &RevokeAllIssuedBeforeReply{}, nil
+}
@@ -2,6 +2,7 @@ package shared
 
 import (
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -15,23 +16,82 @@ import (
 	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
 )
 
+// promiseDomainTag domain-separates the opening fee params hash from any
+// other signature the LSP key might be asked to produce.
+const promiseDomainTag = "lsp_opening_fee_params_v1"
+
+// Promise versions. A versioned promise blob is the version byte, a 4-byte
+// big-endian issuedAt and the compact signature bytes. Legacy promises are
+// a bare compact signature with no version byte; promiseVersionLegacyJSON
+// is the version verifyPromise assigns to them by their length.
+const (
+	// promiseVersionLegacyJSON hashes the params as a JSON-encoded array,
+	// exactly like the original unversioned promises did. It only exists
+	// so promises issued before the TLV migration keep validating until
+	// openingService.legacyCutover.
+	promiseVersionLegacyJSON byte = 0x00
+	// promiseVersionTLV hashes the params as a canonical, sorted TLV
+	// stream. This is the version createPromise issues today.
+	promiseVersionTLV byte = 0x01
+)
+
+// TLV types for the canonical OpeningFeeParams encoding. 7-15 are reserved
+// for fields added by future requests so existing promises keep decoding.
+const (
+	tlvTypeMinFeeMsat           uint64 = 1
+	tlvTypeProportional         uint64 = 2
+	tlvTypeValidUntil           uint64 = 3
+	tlvTypeMinLifetime          uint64 = 4
+	tlvTypeMaxClientToSelfDelay uint64 = 5
+	// tlvTypeIssuedAt carries the unix-seconds timestamp the promise was
+	// signed at, so RevokeAllIssuedBefore can reject promises by age
+	// without the LSP having to persist every hash it ever issued.
+	tlvTypeIssuedAt uint64 = 6
+)
+
+// Errors returned by ValidateOpeningFeeParams, distinct so callers can tell
+// a client to refetch the menu (revoked/expired) apart from a plain bad
+// promise.
+var (
+	ErrOpeningFeeParamsInvalid = fmt.Errorf("invalid opening fee params promise")
+	ErrOpeningFeeParamsExpired = fmt.Errorf("opening fee params promise expired")
+	ErrOpeningFeeParamsRevoked = fmt.Errorf("opening fee params promise revoked")
+)
+
 type OpeningService interface {
 	GetFeeParamsMenu(token string, privateKey *btcec.PrivateKey) ([]*OpeningFeeParams, error)
-	ValidateOpeningFeeParams(params *OpeningFeeParams, publicKey *btcec.PublicKey) bool
+	ValidateOpeningFeeParams(params *OpeningFeeParams, publicKey *btcec.PublicKey) error
+
+	// RevokePromise invalidates every outstanding promise for the menu
+	// entry identified by hash (see revocationKeyHash) -- i.e. every
+	// client that fetched this fee params entry, not just one instance of
+	// it. ValidateOpeningFeeParams starts rejecting it with
+	// ErrOpeningFeeParamsRevoked immediately.
+	RevokePromise(hash []byte) error
+	// RevokeAllIssuedBefore invalidates every promise signed at or before
+	// t, without needing to know any of their hashes.
+	RevokeAllIssuedBefore(t time.Time) error
 }
 
 type openingService struct {
 	store        interceptor.InterceptStore
 	nodesService NodesService
+
+	// legacyCutover is the point after which promise verification stops
+	// accepting promiseVersionLegacyJSON promises. Promises signed before
+	// the TLV migration remain valid until this time.
+	legacyCutover time.Time
 }
 
 func NewOpeningService(
 	store interceptor.InterceptStore,
 	nodesService NodesService,
+	legacyCutover time.Time,
 ) OpeningService {
 	return &openingService{
-		store:        store,
-		nodesService: nodesService,
+		store:         store,
+		nodesService:  nodesService,
+		legacyCutover: legacyCutover,
 	}
 }
 
@@ -86,32 +146,72 @@ func (s *openingService) GetFeeParamsMenu(token string, privateKey *btcec.Privat
 	return menu, nil
 }
 
-func (s *openingService) ValidateOpeningFeeParams(params *OpeningFeeParams, publicKey *btcec.PublicKey) bool {
+func (s *openingService) ValidateOpeningFeeParams(params *OpeningFeeParams, publicKey *btcec.PublicKey) error {
 	if params == nil {
-		return false
+		return ErrOpeningFeeParamsInvalid
+	}
+
+	hash, issuedAt, err := s.verifyPromise(publicKey, params)
+	if err != nil {
+		log.Printf("validateOpeningFeeParams: verifyPromise error: %v", err)
+		return ErrOpeningFeeParamsInvalid
+	}
+
+	revoked, err := s.store.IsOpeningFeeParamsPromiseRevoked(hash)
+	if err != nil {
+		log.Printf("validateOpeningFeeParams: IsOpeningFeeParamsPromiseRevoked error: %v", err)
+		return ErrOpeningFeeParamsInvalid
+	}
+	if revoked {
+		return ErrOpeningFeeParamsRevoked
 	}
 
-	err := verifyPromise(publicKey, params)
+	revokedBefore, err := s.store.GetOpeningFeeParamsRevokedBefore()
 	if err != nil {
-		return false
+		log.Printf("validateOpeningFeeParams: GetOpeningFeeParamsRevokedBefore error: %v", err)
+		return ErrOpeningFeeParamsInvalid
+	}
+	// Legacy promises predate the issuedAt TLV field, so their issuedAt is
+	// always the zero time here, which is "before" any cutoff. Treat them
+	// as always subject to RevokeAllIssuedBefore rather than silently
+	// exempting every outstanding legacy promise from it -- the whole
+	// point of this RPC is to contain an emergency (key compromise,
+	// mispriced menu), and legacy promises are exactly the oldest, most
+	// suspect ones.
+	if !revokedBefore.IsZero() && !issuedAt.After(revokedBefore) {
+		return ErrOpeningFeeParamsRevoked
 	}
 
 	t, err := time.Parse(basetypes.TIME_FORMAT, params.ValidUntil)
 	if err != nil {
 		log.Printf("validateOpeningFeeParams: time.Parse(%v, %v) error: %v", basetypes.TIME_FORMAT, params.ValidUntil, err)
-		return false
+		return ErrOpeningFeeParamsInvalid
 	}
 
 	if time.Now().UTC().After(t) {
 		log.Printf("validateOpeningFeeParams: promise not valid anymore: %v", t)
-		return false
+		return ErrOpeningFeeParamsExpired
 	}
 
-	return true
+	return nil
+}
+
+// RevokePromise invalidates every promise sharing the given revocationKeyHash
+// (same fee params and ValidUntil), regardless of issuedAt.
+func (s *openingService) RevokePromise(hash []byte) error {
+	return s.store.RevokeOpeningFeeParamsPromise(hash)
+}
+
+// RevokeAllIssuedBefore invalidates every promise signed at or before t. It
+// relies on the issuedAt TLV field embedded in each promise rather than a
+// list of previously issued hashes.
+func (s *openingService) RevokeAllIssuedBefore(t time.Time) error {
+	return s.store.SetOpeningFeeParamsRevokedBefore(t)
 }
 
 func createPromise(lspPrivateKey *btcec.PrivateKey, params *OpeningFeeParams) (*string, error) {
-	hash, err := paramsHash(params)
+	issuedAt := uint32(time.Now().UTC().Unix())
+	hash, err := tlvParamsHash(issuedAt, params)
 	if err != nil {
 		return nil, err
 	}
@@ -121,12 +221,37 @@ func createPromise(lspPrivateKey *btcec.PrivateKey, params *OpeningFeeParams) (*
 		log.Printf("createPromise: SignCompact error: %v", err)
 		return nil, err
 	}
-	promise := hex.EncodeToString(sig)
+
+	var issuedAtBuf [4]byte
+	binary.BigEndian.PutUint32(issuedAtBuf[:], issuedAt)
+	blob := append([]byte{promiseVersionTLV}, issuedAtBuf[:]...)
+	blob = append(blob, sig...)
+	promise := hex.EncodeToString(blob)
 	return &promise, nil
 }
 
-func paramsHash(params *OpeningFeeParams) ([]byte, error) {
-	// First hash all the values in the params in a fixed order.
+// paramsHash computes the domain-separated hash that gets signed into a
+// promise. Unknown versions are rejected by the caller before this is
+// reached; paramsHash itself only knows how to encode versions it was
+// built to support. issuedAt is ignored for promiseVersionLegacyJSON, which
+// predates the issuedAt TLV field.
+func paramsHash(version byte, issuedAt uint32, params *OpeningFeeParams) ([]byte, error) {
+	switch version {
+	case promiseVersionLegacyJSON:
+		return legacyParamsHash(params)
+	case promiseVersionTLV:
+		return tlvParamsHash(issuedAt, params)
+	default:
+		return nil, fmt.Errorf("unsupported promise version %d", version)
+	}
+}
+
+// legacyParamsHash reproduces the original, unversioned hash: a Go-JSON
+// encoded array of the params fields, hashed with SHA-256. Its byte layout
+// depends on encoding/json internals, which is exactly why new promises use
+// tlvParamsHash instead. Kept only to verify legacy promises presented
+// before the openingService's legacyCutover, and as their revocation key.
+func legacyParamsHash(params *OpeningFeeParams) ([]byte, error) {
 	items := []interface{}{
 		params.MinFeeMsat,
 		params.Proportional,
@@ -136,31 +261,145 @@ func paramsHash(params *OpeningFeeParams) ([]byte, error) {
 	}
 	blob, err := json.Marshal(items)
 	if err != nil {
-		log.Printf("paramsHash error: %v", err)
+		log.Printf("legacyParamsHash error: %v", err)
 		return nil, err
 	}
 	hash := sha256.Sum256(blob)
 	return hash[:], nil
 }
 
-func verifyPromise(lspPublicKey *btcec.PublicKey, params *OpeningFeeParams) error {
-	hash, err := paramsHash(params)
+// tlvMenuRecords returns the TLV records shared by tlvParamsHash and
+// tlvMenuHash: every fee-params field except issuedAt, which tlvParamsHash
+// alone appends.
+func tlvMenuRecords(params *OpeningFeeParams) []tlvRecord {
+	return []tlvRecord{
+		tlvUint64(tlvTypeMinFeeMsat, params.MinFeeMsat),
+		tlvUint32(tlvTypeProportional, params.Proportional),
+		tlvString(tlvTypeValidUntil, params.ValidUntil),
+		tlvUint32(tlvTypeMinLifetime, params.MinLifetime),
+		tlvUint32(tlvTypeMaxClientToSelfDelay, params.MaxClientToSelfDelay),
+	}
+}
+
+// tlvParamsHash encodes the params as a canonical, sorted TLV stream
+// prefixed with a domain-separation tag, so the layout no longer depends on
+// encoding/json and new fields can be added in reserved type ranges without
+// invalidating promises that don't use them. This is the hash that actually
+// gets signed; it includes issuedAt so every issued promise signs over a
+// distinct timestamp. Use tlvMenuHash, not this, as a revocation key.
+func tlvParamsHash(issuedAt uint32, params *OpeningFeeParams) ([]byte, error) {
+	records := append(tlvMenuRecords(params), tlvUint32(tlvTypeIssuedAt, issuedAt))
+	tlvBlob, err := encodeTLVStream(records...)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("tlvParamsHash: %w", err)
 	}
-	sig, err := hex.DecodeString(params.Promise)
+
+	blob := append([]byte(promiseDomainTag), tlvBlob...)
+	hash := sha256.Sum256(blob)
+	return hash[:], nil
+}
+
+// tlvMenuHash hashes the same fields as tlvParamsHash minus issuedAt, so
+// every promise issued for the same menu entry (same fee params and
+// ValidUntil) shares one hash. This, not tlvParamsHash, is the key
+// RevokePromise and the revocation store use: keying on the signing hash
+// would make RevokePromise revoke only the one instance a client happened
+// to fetch, not the mispriced/compromised menu entry every client fetched.
+func tlvMenuHash(params *OpeningFeeParams) ([]byte, error) {
+	tlvBlob, err := encodeTLVStream(tlvMenuRecords(params)...)
+	if err != nil {
+		return nil, fmt.Errorf("tlvMenuHash: %w", err)
+	}
+
+	blob := append([]byte(promiseDomainTag), tlvBlob...)
+	hash := sha256.Sum256(blob)
+	return hash[:], nil
+}
+
+// revocationKeyHash returns the hash that RevokePromise and the revocation
+// store use to identify params, which intentionally excludes issuedAt (see
+// tlvMenuHash). Legacy promises never had an issuedAt, so their existing
+// hash already serves this purpose.
+func revocationKeyHash(version byte, params *OpeningFeeParams) ([]byte, error) {
+	switch version {
+	case promiseVersionLegacyJSON:
+		return legacyParamsHash(params)
+	case promiseVersionTLV:
+		return tlvMenuHash(params)
+	default:
+		return nil, fmt.Errorf("unsupported promise version %d", version)
+	}
+}
+
+// errLegacyPromiseExpired is returned when a promise signed with
+// promiseVersionLegacyJSON is presented after the configured legacyCutover.
+var errLegacyPromiseExpired = fmt.Errorf("legacy promise version is no longer accepted")
+
+// compactSigLen is the length in bytes of a btcec ecdsa.SignCompact
+// signature (1 recovery-id byte + 32-byte r + 32-byte s).
+const compactSigLen = 65
+
+// verifyPromise recovers the signer from params.Promise and, on success,
+// returns the revocationKeyHash (the revocation registry's key, which
+// excludes issuedAt) and the time the promise was issued (zero for legacy
+// promises, which predate issuedAt).
+func (s *openingService) verifyPromise(lspPublicKey *btcec.PublicKey, params *OpeningFeeParams) ([]byte, time.Time, error) {
+	blob, err := hex.DecodeString(params.Promise)
 	if err != nil {
 		log.Printf("verifyPromise: hex.DecodeString error: %v", err)
-		return err
+		return nil, time.Time{}, err
+	}
+
+	// Promises issued before the TLV migration are a bare compact sig with
+	// no version or issuedAt prefix. Current promises carry a one-byte
+	// version and a 4-byte big-endian issuedAt ahead of the sig.
+	var version byte
+	var issuedAt uint32
+	var issuedAtTime time.Time
+	var sig []byte
+	switch len(blob) {
+	case compactSigLen:
+		version = promiseVersionLegacyJSON
+		sig = blob
+	case 1 + 4 + compactSigLen:
+		version = blob[0]
+		if version != promiseVersionTLV {
+			// The versioned layout only exists for TLV promises. A bare
+			// legacy compact sig re-wrapped with a forged version/issuedAt
+			// prefix must not be accepted here: legacyParamsHash doesn't
+			// cover issuedAt, so the original signature would still
+			// recover and the forged issuedAt would let a revoked legacy
+			// promise slip past RevokeAllIssuedBefore.
+			return nil, time.Time{}, fmt.Errorf("unsupported promise version %d", version)
+		}
+		issuedAt = binary.BigEndian.Uint32(blob[1:5])
+		issuedAtTime = time.Unix(int64(issuedAt), 0).UTC()
+		sig = blob[5:]
+	default:
+		return nil, time.Time{}, fmt.Errorf("invalid promise length %d", len(blob))
+	}
+
+	if version == promiseVersionLegacyJSON && !s.legacyCutover.IsZero() && time.Now().UTC().After(s.legacyCutover) {
+		return nil, time.Time{}, errLegacyPromiseExpired
+	}
+
+	signingHash, err := paramsHash(version, issuedAt, params)
+	if err != nil {
+		return nil, time.Time{}, err
 	}
-	pub, _, err := ecdsa.RecoverCompact(sig, hash)
+
+	pub, _, err := ecdsa.RecoverCompact(sig, signingHash)
 	if err != nil {
 		log.Printf("verifyPromise: RecoverCompact(%x) error: %v", sig, err)
-		return err
+		return nil, time.Time{}, err
 	}
 	if !lspPublicKey.IsEqual(pub) {
-		log.Print("verifyPromise: not signed by us", err)
-		return fmt.Errorf("invalid promise")
+		return nil, time.Time{}, fmt.Errorf("invalid promise")
 	}
-	return nil
+
+	hash, err := revocationKeyHash(version, params)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return hash, issuedAtTime, nil
 }
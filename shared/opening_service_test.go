@@ -0,0 +1,354 @@
+package shared
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/breez/lspd/basetypes"
+	"github.com/breez/lspd/interceptor"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+)
+
+func testParams(t *testing.T, validUntil time.Time) *OpeningFeeParams {
+	t.Helper()
+	return &OpeningFeeParams{
+		MinFeeMsat:           2000000,
+		Proportional:         1000,
+		ValidUntil:           validUntil.UTC().Format(basetypes.TIME_FORMAT),
+		MinLifetime:          4032,
+		MaxClientToSelfDelay: 2016,
+	}
+}
+
+func TestTLVParamsHashIsDeterministic(t *testing.T) {
+	params := testParams(t, time.Now().Add(time.Hour))
+
+	h1, err := tlvParamsHash(123, params)
+	if err != nil {
+		t.Fatalf("tlvParamsHash: %v", err)
+	}
+	h2, err := tlvParamsHash(123, params)
+	if err != nil {
+		t.Fatalf("tlvParamsHash: %v", err)
+	}
+	if !bytes.Equal(h1, h2) {
+		t.Fatalf("tlvParamsHash is not deterministic for identical input")
+	}
+
+	h3, err := tlvParamsHash(124, params)
+	if err != nil {
+		t.Fatalf("tlvParamsHash: %v", err)
+	}
+	if bytes.Equal(h1, h3) {
+		t.Fatalf("tlvParamsHash did not change with issuedAt")
+	}
+}
+
+func TestTLVMenuHashExcludesIssuedAt(t *testing.T) {
+	params := testParams(t, time.Now().Add(time.Hour))
+
+	menuHash, err := tlvMenuHash(params)
+	if err != nil {
+		t.Fatalf("tlvMenuHash: %v", err)
+	}
+
+	signingHashA, err := tlvParamsHash(1, params)
+	if err != nil {
+		t.Fatalf("tlvParamsHash: %v", err)
+	}
+	signingHashB, err := tlvParamsHash(2, params)
+	if err != nil {
+		t.Fatalf("tlvParamsHash: %v", err)
+	}
+	if bytes.Equal(signingHashA, signingHashB) {
+		t.Fatalf("signing hash should differ across issuedAt values")
+	}
+
+	menuHashAgain, err := tlvMenuHash(params)
+	if err != nil {
+		t.Fatalf("tlvMenuHash: %v", err)
+	}
+	if !bytes.Equal(menuHash, menuHashAgain) {
+		t.Fatalf("tlvMenuHash should be stable across calls regardless of issuedAt")
+	}
+}
+
+func TestLegacyParamsHashMatchesJSONArrayEncoding(t *testing.T) {
+	params := testParams(t, time.Now().Add(time.Hour))
+
+	got, err := legacyParamsHash(params)
+	if err != nil {
+		t.Fatalf("legacyParamsHash: %v", err)
+	}
+
+	// legacyParamsHash must keep hashing a JSON array of exactly these
+	// fields, in this order, or every outstanding pre-migration promise
+	// stops validating.
+	items := []interface{}{
+		params.MinFeeMsat,
+		params.Proportional,
+		params.ValidUntil,
+		params.MinLifetime,
+		params.MaxClientToSelfDelay,
+	}
+	blob, err := json.Marshal(items)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	want := sha256.Sum256(blob)
+
+	if !bytes.Equal(got, want[:]) {
+		t.Fatalf("legacyParamsHash changed its encoding: got %x want %x", got, want)
+	}
+}
+
+// legacyPromise signs params the way promises were signed before the TLV
+// migration: a bare compact sig, no version or issuedAt prefix.
+func legacyPromise(t *testing.T, priv *btcec.PrivateKey, params *OpeningFeeParams) string {
+	t.Helper()
+	hash, err := legacyParamsHash(params)
+	if err != nil {
+		t.Fatalf("legacyParamsHash: %v", err)
+	}
+	sig, err := ecdsa.SignCompact(priv, hash, true)
+	if err != nil {
+		t.Fatalf("SignCompact: %v", err)
+	}
+	return hex.EncodeToString(sig)
+}
+
+func TestVerifyPromiseAcceptsBothBlobLengths(t *testing.T) {
+	priv, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatalf("NewPrivateKey: %v", err)
+	}
+	pub := priv.PubKey()
+
+	t.Run("tlv promise from createPromise", func(t *testing.T) {
+		params := testParams(t, time.Now().Add(time.Hour))
+		promise, err := createPromise(priv, params)
+		if err != nil {
+			t.Fatalf("createPromise: %v", err)
+		}
+		params.Promise = *promise
+
+		svc := &openingService{store: nil}
+		if _, _, err := svc.verifyPromise(pub, params); err != nil {
+			t.Fatalf("verifyPromise rejected a freshly created TLV promise: %v", err)
+		}
+	})
+
+	t.Run("legacy bare-sig promise", func(t *testing.T) {
+		params := testParams(t, time.Now().Add(time.Hour))
+		params.Promise = legacyPromise(t, priv, params)
+
+		svc := &openingService{store: nil, legacyCutover: time.Now().Add(time.Hour)}
+		if _, _, err := svc.verifyPromise(pub, params); err != nil {
+			t.Fatalf("verifyPromise rejected a legacy promise before cutover: %v", err)
+		}
+	})
+
+	t.Run("legacy promise rejected after cutover", func(t *testing.T) {
+		params := testParams(t, time.Now().Add(time.Hour))
+		params.Promise = legacyPromise(t, priv, params)
+
+		svc := &openingService{store: nil, legacyCutover: time.Now().Add(-time.Hour)}
+		if _, _, err := svc.verifyPromise(pub, params); err == nil {
+			t.Fatalf("verifyPromise accepted a legacy promise past legacyCutover")
+		}
+	})
+
+	t.Run("legacy sig re-wrapped with a forged version and issuedAt is rejected", func(t *testing.T) {
+		params := testParams(t, time.Now().Add(time.Hour))
+		legacySig, err := hex.DecodeString(legacyPromise(t, priv, params))
+		if err != nil {
+			t.Fatalf("hex.DecodeString: %v", err)
+		}
+
+		// legacyParamsHash never covers issuedAt, so a bare legacy sig
+		// stays valid against any forged issuedAt stuffed into the
+		// versioned layout. verifyPromise must refuse to parse a
+		// promiseVersionLegacyJSON byte out of the versioned blob at all,
+		// or this would let a revoked legacy promise dodge
+		// RevokeAllIssuedBefore by claiming a fresh issuedAt.
+		forged := make([]byte, 0, 1+4+len(legacySig))
+		forged = append(forged, promiseVersionLegacyJSON)
+		forged = binary.BigEndian.AppendUint32(forged, uint32(time.Now().Add(time.Hour).Unix()))
+		forged = append(forged, legacySig...)
+		params.Promise = hex.EncodeToString(forged)
+
+		svc := &openingService{store: nil}
+		if _, _, err := svc.verifyPromise(pub, params); err == nil {
+			t.Fatalf("verifyPromise accepted a legacy sig re-wrapped with a forged version/issuedAt prefix")
+		}
+	})
+}
+
+// TestCreatePromiseBlobLayout checks createPromise's blob layout (version ||
+// issuedAt || sig) is exactly what verifyPromise expects to parse.
+func TestCreatePromiseBlobLayout(t *testing.T) {
+	priv, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatalf("NewPrivateKey: %v", err)
+	}
+	params := testParams(t, time.Now().Add(time.Hour))
+
+	promise, err := createPromise(priv, params)
+	if err != nil {
+		t.Fatalf("createPromise: %v", err)
+	}
+
+	blob, err := hex.DecodeString(*promise)
+	if err != nil {
+		t.Fatalf("hex.DecodeString: %v", err)
+	}
+	if len(blob) != 1+4+compactSigLen {
+		t.Fatalf("got promise blob length %d, want %d", len(blob), 1+4+compactSigLen)
+	}
+	if blob[0] != promiseVersionTLV {
+		t.Fatalf("got version byte %d, want %d", blob[0], promiseVersionTLV)
+	}
+
+	issuedAt := binary.BigEndian.Uint32(blob[1:5])
+	if time.Since(time.Unix(int64(issuedAt), 0)) > time.Minute {
+		t.Fatalf("issuedAt %d is not close to now", issuedAt)
+	}
+}
+
+// fakeInterceptStore is an in-memory interceptor.InterceptStore good enough
+// to drive ValidateOpeningFeeParams / RevokePromise / RevokeAllIssuedBefore
+// without a real Postgres instance.
+type fakeInterceptStore struct {
+	revoked       map[string]bool
+	revokedBefore time.Time
+}
+
+var _ interceptor.InterceptStore = (*fakeInterceptStore)(nil)
+
+func newFakeInterceptStore() *fakeInterceptStore {
+	return &fakeInterceptStore{revoked: make(map[string]bool)}
+}
+
+func (f *fakeInterceptStore) GetFeeParamsSettings(token string) ([]*interceptor.OpeningFeeParamsSetting, error) {
+	return nil, nil
+}
+
+func (f *fakeInterceptStore) IsOpeningFeeParamsPromiseRevoked(hash []byte) (bool, error) {
+	return f.revoked[hex.EncodeToString(hash)], nil
+}
+
+func (f *fakeInterceptStore) RevokeOpeningFeeParamsPromise(hash []byte) error {
+	f.revoked[hex.EncodeToString(hash)] = true
+	return nil
+}
+
+func (f *fakeInterceptStore) GetOpeningFeeParamsRevokedBefore() (time.Time, error) {
+	return f.revokedBefore, nil
+}
+
+func (f *fakeInterceptStore) SetOpeningFeeParamsRevokedBefore(t time.Time) error {
+	if t.After(f.revokedBefore) {
+		f.revokedBefore = t
+	}
+	return nil
+}
+
+func TestValidateOpeningFeeParamsErrorPaths(t *testing.T) {
+	priv, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatalf("NewPrivateKey: %v", err)
+	}
+	pub := priv.PubKey()
+
+	newValidParams := func(t *testing.T) *OpeningFeeParams {
+		params := testParams(t, time.Now().Add(time.Hour))
+		promise, err := createPromise(priv, params)
+		if err != nil {
+			t.Fatalf("createPromise: %v", err)
+		}
+		params.Promise = *promise
+		return params
+	}
+
+	t.Run("nil params", func(t *testing.T) {
+		svc := &openingService{store: newFakeInterceptStore()}
+		if err := svc.ValidateOpeningFeeParams(nil, pub); err != ErrOpeningFeeParamsInvalid {
+			t.Fatalf("got %v, want ErrOpeningFeeParamsInvalid", err)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		params := testParams(t, time.Now().Add(-time.Hour))
+		promise, err := createPromise(priv, params)
+		if err != nil {
+			t.Fatalf("createPromise: %v", err)
+		}
+		params.Promise = *promise
+
+		svc := &openingService{store: newFakeInterceptStore()}
+		if err := svc.ValidateOpeningFeeParams(params, pub); err != ErrOpeningFeeParamsExpired {
+			t.Fatalf("got %v, want ErrOpeningFeeParamsExpired", err)
+		}
+	})
+
+	t.Run("revoked by hash", func(t *testing.T) {
+		params := newValidParams(t)
+		store := newFakeInterceptStore()
+		svc := &openingService{store: store}
+
+		hash, err := tlvMenuHash(params)
+		if err != nil {
+			t.Fatalf("tlvMenuHash: %v", err)
+		}
+		if err := store.RevokeOpeningFeeParamsPromise(hash); err != nil {
+			t.Fatalf("RevokeOpeningFeeParamsPromise: %v", err)
+		}
+
+		if err := svc.ValidateOpeningFeeParams(params, pub); err != ErrOpeningFeeParamsRevoked {
+			t.Fatalf("got %v, want ErrOpeningFeeParamsRevoked", err)
+		}
+	})
+
+	t.Run("revoked by RevokeAllIssuedBefore", func(t *testing.T) {
+		params := newValidParams(t)
+		store := newFakeInterceptStore()
+		svc := &openingService{store: store}
+
+		if err := svc.RevokeAllIssuedBefore(time.Now().Add(time.Minute)); err != nil {
+			t.Fatalf("RevokeAllIssuedBefore: %v", err)
+		}
+
+		if err := svc.ValidateOpeningFeeParams(params, pub); err != ErrOpeningFeeParamsRevoked {
+			t.Fatalf("got %v, want ErrOpeningFeeParamsRevoked", err)
+		}
+	})
+
+	t.Run("legacy promise revoked by RevokeAllIssuedBefore despite zero issuedAt", func(t *testing.T) {
+		params := testParams(t, time.Now().Add(time.Hour))
+		params.Promise = legacyPromise(t, priv, params)
+		store := newFakeInterceptStore()
+		svc := &openingService{store: store}
+
+		if err := svc.RevokeAllIssuedBefore(time.Now()); err != nil {
+			t.Fatalf("RevokeAllIssuedBefore: %v", err)
+		}
+
+		if err := svc.ValidateOpeningFeeParams(params, pub); err != ErrOpeningFeeParamsRevoked {
+			t.Fatalf("got %v, want ErrOpeningFeeParamsRevoked for a legacy promise", err)
+		}
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		params := newValidParams(t)
+		svc := &openingService{store: newFakeInterceptStore()}
+		if err := svc.ValidateOpeningFeeParams(params, pub); err != nil {
+			t.Fatalf("got %v, want nil", err)
+		}
+	})
+}
@@ -0,0 +1,80 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// writeBigSize encodes val using the BOLT bigsize format: a compact,
+// big-endian varint used throughout the TLV encodings in the lightning
+// specs.
+func writeBigSize(w io.Writer, val uint64) error {
+	switch {
+	case val < 0xfd:
+		_, err := w.Write([]byte{byte(val)})
+		return err
+	case val < 0x10000:
+		var buf [3]byte
+		buf[0] = 0xfd
+		binary.BigEndian.PutUint16(buf[1:], uint16(val))
+		_, err := w.Write(buf[:])
+		return err
+	case val < 0x100000000:
+		var buf [5]byte
+		buf[0] = 0xfe
+		binary.BigEndian.PutUint32(buf[1:], uint32(val))
+		_, err := w.Write(buf[:])
+		return err
+	default:
+		var buf [9]byte
+		buf[0] = 0xff
+		binary.BigEndian.PutUint64(buf[1:], val)
+		_, err := w.Write(buf[:])
+		return err
+	}
+}
+
+// tlvRecord is a single `type`/`length`/`value` tuple as used by the
+// opening fee params canonical encoding. Records must be appended in
+// ascending type order; callers are responsible for that ordering since
+// Go struct literals already list the fields in a fixed sequence.
+type tlvRecord struct {
+	tlvType uint64
+	value   []byte
+}
+
+func tlvUint32(tlvType uint64, val uint32) tlvRecord {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, val)
+	return tlvRecord{tlvType: tlvType, value: buf}
+}
+
+func tlvUint64(tlvType uint64, val uint64) tlvRecord {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, val)
+	return tlvRecord{tlvType: tlvType, value: buf}
+}
+
+func tlvString(tlvType uint64, val string) tlvRecord {
+	return tlvRecord{tlvType: tlvType, value: []byte(val)}
+}
+
+// encodeTLVStream writes out records as type/length/value tuples in the
+// order given. It does not sort them; see tlvRecord.
+func encodeTLVStream(records ...tlvRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, rec := range records {
+		if err := writeBigSize(&buf, rec.tlvType); err != nil {
+			return nil, fmt.Errorf("failed to write tlv type %d: %w", rec.tlvType, err)
+		}
+		if err := writeBigSize(&buf, uint64(len(rec.value))); err != nil {
+			return nil, fmt.Errorf("failed to write tlv length for type %d: %w", rec.tlvType, err)
+		}
+		if _, err := buf.Write(rec.value); err != nil {
+			return nil, fmt.Errorf("failed to write tlv value for type %d: %w", rec.tlvType, err)
+		}
+	}
+	return buf.Bytes(), nil
+}